@@ -0,0 +1,532 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// lostProfileEvent is the function to which lost profiling
+// events are attributed.
+// (The name shows up in the pprof graphs.)
+func lostProfileEvent() { lostProfileEvent() }
+
+// funcPC returns the entry PC of the function f.
+// addCPUData uses it to attribute lost samples to lostProfileEvent,
+// and tests use it to synthesize PCs that correspond to known functions.
+func funcPC(f interface{}) uintptr {
+	return reflect.ValueOf(f).Pointer()
+}
+
+// A profileBuilder writes a profile incrementally from a
+// stream of profile samples delivered by the runtime.
+type profileBuilder struct {
+	start      time.Time
+	end        time.Time
+	havePeriod bool
+	period     int64
+	m          profMap
+
+	// encoding state
+	w     io.Writer
+	pb    protobuf
+	locs  map[uintptr]uint64 // PC -> location ID
+	funcs map[string]int     // function name -> Function.ID
+	mem   []memMap
+}
+
+type memMap struct {
+	// initialized as reading mapping
+	start   uintptr // Address at which the binary (or DLL) is loaded into memory.
+	end     uintptr // The limit of the address range occupied by this mapping.
+	offset  uint64  // Offset in the binary that corresponds to the first mapped address.
+	file    string  // The object this entry is loaded from.
+	buildID string  // A string that uniquely identifies a particular program version with high probability.
+
+	funcs bool // true once a PC in this mapping has resolved to at least one function
+	fake  bool // map entry was faked; /proc/self/maps wasn't available
+}
+
+const (
+	// message Profile
+	tagProfile_SampleType    = 1  // repeated ValueType
+	tagProfile_Sample        = 2  // repeated Sample
+	tagProfile_Mapping       = 3  // repeated Mapping
+	tagProfile_Location      = 4  // repeated Location
+	tagProfile_Function      = 5  // repeated Function
+	tagProfile_StringTable   = 6  // repeated string
+	tagProfile_DropFrames    = 7  // int64 (string table index)
+	tagProfile_KeepFrames    = 8  // int64 (string table index)
+	tagProfile_TimeNanos     = 9  // int64
+	tagProfile_DurationNanos = 10 // int64
+	tagProfile_PeriodType    = 11 // ValueType (really optional string???)
+	tagProfile_Period        = 12 // int64
+
+	// message ValueType
+	tagValueType_Type = 1 // int64 (string table index)
+	tagValueType_Unit = 2 // int64 (string table index)
+
+	// message Sample
+	tagSample_Location = 1 // repeated uint64
+	tagSample_Value    = 2 // repeated int64
+	tagSample_Label    = 3 // repeated Label
+
+	// message Label
+	tagLabel_Key = 1 // int64 (string table index)
+	tagLabel_Str = 2 // int64 (string table index)
+	tagLabel_Num = 3 // int64
+
+	// message Mapping
+	tagMapping_ID           = 1 // uint64
+	tagMapping_Start        = 2 // uint64
+	tagMapping_Limit        = 3 // uint64
+	tagMapping_Offset       = 4 // uint64
+	tagMapping_Filename     = 5 // int64 (string table index)
+	tagMapping_BuildID      = 6 // int64 (string table index)
+	tagMapping_HasFunctions = 7 // bool
+
+	// message Location
+	tagLocation_ID        = 1 // uint64
+	tagLocation_MappingID = 2 // uint64
+	tagLocation_Address   = 3 // uint64
+	tagLocation_Line      = 4 // repeated Line
+
+	// message Line
+	tagLine_FunctionID = 1 // uint64
+	tagLine_Line       = 2 // int64
+
+	// message Function
+	tagFunction_ID         = 1 // uint64
+	tagFunction_Name       = 2 // int64 (string table index)
+	tagFunction_SystemName = 3 // int64 (string table index)
+	tagFunction_Filename   = 4 // int64 (string table index)
+)
+
+// stringIndex adds s to round's string table if not already present and
+// returns the index of s in that table. The table is scoped to round,
+// not to the builder, so that each round's encoded message only ever
+// carries the strings it actually references: a round's Function,
+// Mapping, Label, and ValueType messages all resolve their string-table
+// indices against round.strings, never against any other round's.
+func (b *profileBuilder) stringIndex(round *emitRound, s string) int64 {
+	id, ok := round.stringMap[s]
+	if !ok {
+		id = len(round.strings)
+		round.strings = append(round.strings, s)
+		round.stringMap[s] = id
+	}
+	return int64(id)
+}
+
+// pbValueType encodes a ValueType message to b.pb.
+func (b *profileBuilder) pbValueType(tag int, typ, unit string, round *emitRound) {
+	start := b.pb.startMessage()
+	b.pb.int64(tagValueType_Type, b.stringIndex(round, typ))
+	b.pb.int64(tagValueType_Unit, b.stringIndex(round, unit))
+	b.pb.endMessage(tag, start)
+}
+
+// pbSample encodes a Sample message to b.pb.
+func (b *profileBuilder) pbSample(values []int64, locs []uint64, labels func()) {
+	start := b.pb.startMessage()
+	b.pb.int64s(tagSample_Value, values)
+	b.pb.uint64s(tagSample_Location, locs)
+	if labels != nil {
+		labels()
+	}
+	b.pb.endMessage(tagProfile_Sample, start)
+}
+
+// pbLabel encodes a Label message to b.pb.
+func (b *profileBuilder) pbLabel(tag int, key, str string, num int64, round *emitRound) {
+	start := b.pb.startMessage()
+	b.pb.int64Opt(tagLabel_Key, b.stringIndex(round, key))
+	b.pb.int64Opt(tagLabel_Str, b.stringIndex(round, str))
+	b.pb.int64Opt(tagLabel_Num, num)
+	b.pb.endMessage(tag, start)
+}
+
+// pbLine encodes a Line message to b.pb.
+func (b *profileBuilder) pbLine(tag int, funcID uint64, line int64) {
+	start := b.pb.startMessage()
+	b.pb.uint64Opt(tagLine_FunctionID, funcID)
+	b.pb.int64Opt(tagLine_Line, line)
+	b.pb.endMessage(tag, start)
+}
+
+// pbMapping encodes a Mapping message to b.pb.
+func (b *profileBuilder) pbMapping(tag int, id, base, limit, offset uint64, file, buildID string, hasFuncs bool, round *emitRound) {
+	start := b.pb.startMessage()
+	b.pb.uint64Opt(tagMapping_ID, id)
+	b.pb.uint64Opt(tagMapping_Start, base)
+	b.pb.uint64Opt(tagMapping_Limit, limit)
+	b.pb.uint64Opt(tagMapping_Offset, offset)
+	b.pb.int64Opt(tagMapping_Filename, b.stringIndex(round, file))
+	b.pb.int64Opt(tagMapping_BuildID, b.stringIndex(round, buildID))
+	if hasFuncs {
+		b.pb.bool(tagMapping_HasFunctions, true)
+	}
+	b.pb.endMessage(tag, start)
+}
+
+// newProfileBuilder returns a new profileBuilder.
+// CPU profiling data obtained from the runtime can be added
+// by calling b.addCPUData, and then the eventual profile
+// can be obtained by calling b.build.
+func newProfileBuilder(w io.Writer) *profileBuilder {
+	b := &profileBuilder{
+		w:     w,
+		start: time.Now(),
+		locs:  map[uintptr]uint64{},
+		funcs: map[string]int{},
+	}
+	b.readMapping()
+	return b
+}
+
+// addCPUData adds the CPU profiling data to the profile.
+//
+// The data must be a whole number of records, as delivered by the runtime.
+// len(tags) must be equal to the number of records in data, or tags must
+// be nil.
+func (b *profileBuilder) addCPUData(data []uint64, tags []unsafe.Pointer) error {
+	if !b.havePeriod {
+		// first record is period
+		if len(data) < 3 {
+			return fmt.Errorf("truncated profile")
+		}
+		if data[0] != 3 || data[2] == 0 {
+			return fmt.Errorf("malformed profile")
+		}
+		// data[2] is sampling period in microseconds. Convert to
+		// nanoseconds.
+		b.period = int64(data[2]) * 1000
+		b.havePeriod = true
+		data = data[3:]
+		if tags != nil {
+			tags = tags[1:]
+		}
+	}
+
+	// Parse CPU samples from the profile.
+	// Each sample is 3+n uint64s:
+	//	data[0] = 3+n
+	//	data[1] = time stamp (ignored)
+	//	data[2] = count
+	//	data[3:3+n] = stack
+	// If the count is 0 and the stack has length 1,
+	// that's an overflow record inserted by the runtime
+	// to indicate that stack[0] samples were lost.
+	// Otherwise the count is usually 1,
+	// but in a few special cases like lost non-Go samples
+	// there can be larger counts.
+	// Because many samples with the same stack arrive,
+	// we want to deduplicate immediately, which we do
+	// using the b.m profMap.
+	for len(data) > 0 {
+		if len(data) < 3 || data[0] > uint64(len(data)) {
+			return fmt.Errorf("truncated profile")
+		}
+		if data[0] < 3 || tags != nil && len(tags) < 1 {
+			return fmt.Errorf("malformed profile")
+		}
+		count := data[2]
+		stk := data[3:data[0]]
+		data = data[data[0]:]
+
+		var tag unsafe.Pointer
+		if tags != nil {
+			tag = tags[0]
+			tags = tags[1:]
+		}
+
+		if count == 0 && len(stk) == 1 {
+			// overflow record
+			count = uint64(stk[0])
+			stk = []uint64{
+				uint64(funcPC(lostProfileEvent) + 1),
+			}
+		}
+		b.m.lookup(stk, tag).count += int64(count)
+	}
+	return nil
+}
+
+// build completes the constructed profile and writes it to b.w.
+func (b *profileBuilder) build() {
+	b.end = time.Now()
+
+	round := newEmitRound()
+
+	b.pb.int64Opt(tagProfile_TimeNanos, b.start.UnixNano())
+	if b.havePeriod { // must be CPU profile
+		b.pbValueType(tagProfile_SampleType, "samples", "count", round)
+		b.pbValueType(tagProfile_SampleType, "cpu", "nanoseconds", round)
+		b.pb.int64Opt(tagProfile_DurationNanos, b.end.Sub(b.start).Nanoseconds())
+		b.pbValueType(tagProfile_PeriodType, "cpu", "nanoseconds", round)
+		b.pb.int64Opt(tagProfile_Period, b.period)
+	}
+
+	values := []int64{0, 0}
+	var locs []uint64
+
+	for e := b.m.all; e != nil; e = e.nextAll {
+		values[0] = e.count
+		values[1] = e.count * b.period
+
+		var labels func()
+		if e.tag != nil {
+			labels = func() {
+				for k, v := range *(*labelMap)(e.tag) {
+					b.pbLabel(tagSample_Label, k, v, 0, round)
+				}
+			}
+		}
+
+		locs = b.appendLocsForStack(locs[:0], e.stk, round)
+		b.pbSample(values, locs, labels)
+	}
+
+	b.emitMappings(round)
+
+	b.pb.strings(tagProfile_StringTable, round.strings)
+	b.w.Write(b.pb.data)
+}
+
+// emitRound tracks which Location and Function entries have already
+// been written to the protobuf message currently under construction, so
+// that a PC or function name referenced by several samples in the same
+// round is only declared once, while still allowing the same PC to be
+// re-declared in a later round (see ProfileStream.Flush). It also holds
+// the round's own string table: every string referenced by a message in
+// this round gets a round-local index, so the round's encoded string
+// table only ever contains strings this round actually uses, however
+// many earlier rounds (and however many distinct strings overall) came
+// before it.
+type emitRound struct {
+	locs      map[uintptr]bool
+	funcs     map[string]bool
+	strings   []string
+	stringMap map[string]int
+}
+
+func newEmitRound() *emitRound {
+	return &emitRound{
+		locs:      map[uintptr]bool{},
+		funcs:     map[string]bool{},
+		strings:   []string{""},
+		stringMap: map[string]int{"": 0},
+	}
+}
+
+// appendLocsForStack appends the location IDs for the given stack trace
+// to the given location ID slice, locs, creating new Location (and, as
+// needed, Function) entries for any PC not yet declared in round.
+//
+// It may return an empty slice even if stk is non-empty, for example if
+// stk consists solely of runtime.goexit. We still count these empty
+// stacks in profiles in order to get the right cumulative sample count.
+func (b *profileBuilder) appendLocsForStack(locs []uint64, stk []uintptr, round *emitRound) (newLocs []uint64) {
+	for i, addr := range stk {
+		// The leaf entry is the PC that was actually executing;
+		// every other entry is a return address, so back it up by
+		// one byte to land on the call instruction itself before
+		// recording it as a Location's Address.
+		callPC := addr
+		if i != 0 {
+			callPC--
+		}
+
+		// Symbolization gets the raw, un-adjusted addr: runtime.CallersFrames
+		// (which the default Symbolizer is built on) already backs up
+		// non-leaf PCs by one byte itself. Handing it the already-adjusted
+		// callPC would back those PCs up twice and resolve the wrong line.
+		frames, ok := currentSymbolizer().FuncForPC(addr)
+		if ok && frames[0].Name == "runtime.goexit" {
+			continue
+		}
+
+		// b.locs assigns each PC a stable ID for the lifetime of the
+		// builder, so that the same call stack keeps the same IDs
+		// across every round (build or Flush) that observes it.
+		id, idOK := b.locs[addr]
+		if !idOK {
+			id = uint64(len(b.locs)) + 1
+			b.locs[addr] = id
+		}
+		if !round.locs[addr] {
+			b.emitLocation(id, callPC, frames, round)
+			round.locs[addr] = true
+		}
+		locs = append(locs, id)
+	}
+	return locs
+}
+
+// emitLocation writes a Location message with the given pre-assigned id
+// for callPC to b.pb. frames holds the chain of functions that the
+// Symbolizer resolved the raw stack entry behind callPC to, innermost
+// (most deeply inlined) first; when the
+// compiler inlined one or more calls at callPC, frames has more than
+// one entry and the Location gets one Line per entry, so inlined
+// callers show up as distinct frames in the generated profile.
+func (b *profileBuilder) emitLocation(id uint64, callPC uintptr, frames []Function, round *emitRound) {
+	// Function messages are siblings of Location at the Profile level,
+	// so they must be written (and closed) before the Location message
+	// is opened below; nesting them inside Location's own
+	// startMessage/endMessage would embed their bytes in the middle of
+	// Location's body and corrupt the encoding.
+	funcIDs := make([]uint64, len(frames))
+	for i, fn := range frames {
+		funcIDs[i] = b.emitFunction(fn.Name, fn.File, round)
+	}
+
+	start := b.pb.startMessage()
+	b.pb.uint64Opt(tagLocation_ID, id)
+	b.pb.uint64Opt(tagLocation_Address, uint64(callPC))
+
+	for i, fn := range frames {
+		b.pbLine(tagLocation_Line, funcIDs[i], int64(fn.Line))
+	}
+
+	for i := range b.mem {
+		if b.mem[i].start <= callPC && callPC < b.mem[i].end || b.mem[i].fake {
+			b.pb.uint64Opt(tagLocation_MappingID, uint64(i+1))
+			b.mem[i].funcs = b.mem[i].funcs || len(frames) > 0
+			break
+		}
+	}
+	b.pb.endMessage(tagProfile_Location, start)
+}
+
+// emitFunction returns the stable Function.ID for name, writing an
+// accompanying Function message to b.pb the first time name is seen in
+// round (the ID itself, once assigned, never changes for the lifetime
+// of the builder).
+func (b *profileBuilder) emitFunction(name, file string, round *emitRound) uint64 {
+	funcID, ok := b.funcs[name]
+	if !ok {
+		funcID = len(b.funcs) + 1
+		b.funcs[name] = funcID
+	}
+	if !round.funcs[name] {
+		start := b.pb.startMessage()
+		b.pb.uint64Opt(tagFunction_ID, uint64(funcID))
+		b.pb.int64Opt(tagFunction_Name, b.stringIndex(round, name))
+		b.pb.int64Opt(tagFunction_SystemName, b.stringIndex(round, name))
+		b.pb.int64Opt(tagFunction_Filename, b.stringIndex(round, file))
+		b.pb.endMessage(tagProfile_Function, start)
+		round.funcs[name] = true
+	}
+	return uint64(funcID)
+}
+
+// emitMappings writes a Mapping message for every memory mapping known
+// to b. It is cheap enough to call once per round, which keeps each
+// round's delta self-contained.
+func (b *profileBuilder) emitMappings(round *emitRound) {
+	for i, m := range b.mem {
+		b.pbMapping(tagProfile_Mapping, uint64(i+1), uint64(m.start), uint64(m.end), m.offset, m.file, m.buildID, m.funcs, round)
+	}
+}
+
+var space = []byte(" ")
+var newline = []byte("\n")
+
+// parseProcSelfMaps parses the contents of /proc/self/maps, a
+// listing of this process's memory mappings, and calls addMapping
+// for each executable mapping found.
+func parseProcSelfMaps(data []byte, addMapping func(lo, hi, offset uint64, file, buildID string)) {
+	// $ cat /proc/self/maps
+	// 00400000-0040b000 r-xp 00000000 fc:01 787766                             /bin/cat
+	// 0060a000-0060b000 r--p 0000a000 fc:01 787766                             /bin/cat
+	// 0060b000-0060c000 rw-p 0000b000 fc:01 787766                             /bin/cat
+	// 014ab000-014cc000 rw-p 00000000 00:00 0                                  [heap]
+	// 7f7d76af8000-7f7d7797c000 r--p 00000000 fc:01 1318064                    /usr/lib/locale/locale-archive
+	// 7f7d7797c000-7f7d77b36000 r-xp 00000000 fc:01 1180226                    /lib/x86_64-linux-gnu/libc-2.19.so
+	// 7ffc342a2000-7ffc342c3000 rw-p 00000000 00:00 0                          [stack]
+	// 7ffc34343000-7ffc34345000 r-xp 00000000 00:00 0                          [vdso]
+
+	var line []byte
+	// next removes and returns the next field in the line.
+	// It also removes from line any spaces following the field.
+	next := func() []byte {
+		var f []byte
+		f, line, _ = bytes.Cut(line, space)
+		line = bytes.TrimLeft(line, " ")
+		return f
+	}
+
+	for len(data) > 0 {
+		line, data, _ = bytes.Cut(data, newline)
+		addr := next()
+		loStr, hiStr, ok := strings.Cut(string(addr), "-")
+		if !ok {
+			continue
+		}
+		lo, err := strconv.ParseUint(loStr, 16, 64)
+		if err != nil {
+			continue
+		}
+		hi, err := strconv.ParseUint(hiStr, 16, 64)
+		if err != nil {
+			continue
+		}
+		perm := next()
+		if len(perm) < 4 || perm[2] != 'x' {
+			// Only interested in executable mappings.
+			continue
+		}
+		offset, err := strconv.ParseUint(string(next()), 16, 64)
+		if err != nil {
+			continue
+		}
+		next()          // dev
+		inode := next() // inode
+		if line == nil {
+			continue
+		}
+		file := string(line)
+
+		// Trim deleted file marker.
+		const deletedStr = " (deleted)"
+		if strings.HasSuffix(file, deletedStr) {
+			file = file[:len(file)-len(deletedStr)]
+		}
+
+		if len(inode) == 1 && inode[0] == '0' && file == "" {
+			// Huge-page text mappings list the initial fragment of
+			// mapped but unpopulated memory as being inode 0.
+			// Don't report that part.
+			// But [vdso] and [vsyscall] are inode 0, so let non-empty file names through.
+			continue
+		}
+
+		buildID, _ := elfBuildID(file)
+		addMapping(lo, hi, offset, file, buildID)
+	}
+}
+
+func (b *profileBuilder) addMapping(lo, hi, offset uint64, file, buildID string) {
+	b.addMappingEntry(lo, hi, offset, file, buildID, false)
+}
+
+func (b *profileBuilder) addMappingEntry(lo, hi, offset uint64, file, buildID string, fake bool) {
+	b.mem = append(b.mem, memMap{
+		start:   uintptr(lo),
+		end:     uintptr(hi),
+		offset:  offset,
+		file:    file,
+		buildID: buildID,
+		fake:    fake,
+	})
+}
@@ -128,6 +128,117 @@ func TestConvertCPUProfile(t *testing.T) {
 	checkProfile(t, p, period, periodType, sampleType, samples)
 }
 
+// TestConvertCPUProfileInlined checks that a PC the Symbolizer resolves
+// to more than one Function, as happens when the compiler inlines one
+// or more calls at that PC, is recorded as a Location with one Line per
+// inlined frame rather than just the single outermost line. It installs
+// a fake Symbolizer so the inline chain is deterministic, rather than
+// depending on the compiler's actual inlining decisions for a real
+// function.
+func TestConvertCPUProfileInlined(t *testing.T) {
+	addr1, _, map1, _ := testPCs(t)
+
+	inlinedFn := Function{Name: "pprof.inlined", File: "inlined.go", Line: 7}
+	callerFn := Function{Name: "pprof.caller", File: "caller.go", Line: 20}
+	restore := WithSymbolizer(fakeSymbolizer{
+		pc:     uintptr(addr1),
+		frames: []Function{inlinedFn, callerFn},
+	})
+	defer restore()
+
+	b := []uint64{
+		3, 0, 2000, // periodMs = 2000
+		4, 0, 10, addr1, // 10 samples in addr1, a single-frame stack
+	}
+	p, err := translateCPUProfile(b)
+	if err != nil {
+		t.Fatalf("translating profile: %v", err)
+	}
+	period := int64(2000 * 1000)
+	periodType := &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+	sampleType := []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "cpu", Unit: "nanoseconds"},
+	}
+	wantFunc := []*profile.Function{
+		{ID: 1, Name: inlinedFn.Name, SystemName: inlinedFn.Name, Filename: inlinedFn.File},
+		{ID: 2, Name: callerFn.Name, SystemName: callerFn.Name, Filename: callerFn.File},
+	}
+	// addr1 resolves via the fake Symbolizer above, so unlike in
+	// TestConvertCPUProfile, the mapping containing it gets marked as
+	// having resolved functions.
+	wantMap1 := *map1
+	wantMap1.HasFunctions = true
+	samples := []*profile.Sample{
+		{Value: []int64{10, 10 * 2000 * 1000}, Location: []*profile.Location{
+			{ID: 1, Mapping: &wantMap1, Address: addr1, Line: []profile.Line{
+				{Function: wantFunc[0], Line: int64(inlinedFn.Line)},
+				{Function: wantFunc[1], Line: int64(callerFn.Line)},
+			}},
+		}},
+	}
+	checkProfile(t, p, period, periodType, sampleType, samples)
+}
+
+// TestConvertCPUProfileInlinedNonLeaf is like TestConvertCPUProfileInlined,
+// but the inlined PC is a non-leaf stack entry rather than the leaf. A
+// non-leaf entry in a raw CPU profile stack is a return address, so
+// appendLocsForStack backs it up by one byte before recording it as a
+// Location's Address -- but it must still hand the Symbolizer the raw,
+// unadjusted address, because the Symbolizer (runtime.CallersFrames, by
+// default) does that adjustment itself. The fake Symbolizer here is
+// keyed on the raw address, so this only passes if appendLocsForStack
+// gets that right.
+func TestConvertCPUProfileInlinedNonLeaf(t *testing.T) {
+	addr1, addr2, map1, map2 := testPCs(t)
+
+	inlinedFn := Function{Name: "pprof.inlined", File: "inlined.go", Line: 7}
+	callerFn := Function{Name: "pprof.caller", File: "caller.go", Line: 20}
+	// The fake Symbolizer is keyed on addr2+2, the raw stack entry below,
+	// not addr2+1, the call PC appendLocsForStack backs it up to for the
+	// Location's recorded Address. That's deliberate: it only resolves if
+	// appendLocsForStack hands the Symbolizer the raw address, exactly as
+	// it must.
+	restore := WithSymbolizer(fakeSymbolizer{
+		pc:     uintptr(addr2 + 2),
+		frames: []Function{inlinedFn, callerFn},
+	})
+	defer restore()
+
+	b := []uint64{
+		3, 0, 2000, // periodMs = 2000
+		5, 0, 10, addr1, addr2 + 2, // 10 samples; addr1 is the leaf, addr2+2 the caller
+	}
+	p, err := translateCPUProfile(b)
+	if err != nil {
+		t.Fatalf("translating profile: %v", err)
+	}
+	period := int64(2000 * 1000)
+	periodType := &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}
+	sampleType := []*profile.ValueType{
+		{Type: "samples", Unit: "count"},
+		{Type: "cpu", Unit: "nanoseconds"},
+	}
+	wantFunc := []*profile.Function{
+		{ID: 1, Name: inlinedFn.Name, SystemName: inlinedFn.Name, Filename: inlinedFn.File},
+		{ID: 2, Name: callerFn.Name, SystemName: callerFn.Name, Filename: callerFn.File},
+	}
+	// addr2+2 resolves via the fake Symbolizer above, so its mapping gets
+	// marked as having resolved functions; addr1's does not.
+	wantMap2 := *map2
+	wantMap2.HasFunctions = true
+	samples := []*profile.Sample{
+		{Value: []int64{10, 10 * 2000 * 1000}, Location: []*profile.Location{
+			{ID: 1, Mapping: map1, Address: addr1},
+			{ID: 2, Mapping: &wantMap2, Address: addr2 + 1, Line: []profile.Line{
+				{Function: wantFunc[0], Line: int64(inlinedFn.Line)},
+				{Function: wantFunc[1], Line: int64(callerFn.Line)},
+			}},
+		}},
+	}
+	checkProfile(t, p, period, periodType, sampleType, samples)
+}
+
 func checkProfile(t *testing.T, p *profile.Profile, period int64, periodType *profile.ValueType, sampleType []*profile.ValueType, samples []*profile.Sample) {
 	if p.Period != period {
 		t.Fatalf("p.Period = %d, want %d", p.Period, period)
@@ -138,11 +249,22 @@ func checkProfile(t *testing.T, p *profile.Profile, period int64, periodType *pr
 	if !reflect.DeepEqual(p.SampleType, sampleType) {
 		t.Fatalf("p.SampleType = %v\nwant = %v", fmtJSON(p.SampleType), fmtJSON(sampleType))
 	}
-	// Clear line info since it is not in the expected samples.
-	// If we used f1 and f2 above, then the samples will have line info.
+	// Clear line info for locations the caller didn't specify Line info
+	// for. If we used f1 and f2 above, then the samples will otherwise
+	// have line info the caller can't predict.
+	wantLine := map[uint64][]profile.Line{}
+	for _, s := range samples {
+		for _, l := range s.Location {
+			if l.Line != nil {
+				wantLine[l.ID] = l.Line
+			}
+		}
+	}
 	for _, s := range p.Sample {
 		for _, l := range s.Location {
-			l.Line = nil
+			if wantLine[l.ID] == nil {
+				l.Line = nil
+			}
 		}
 	}
 	if fmtJSON(p.Sample) != fmtJSON(samples) { // ignore unexported fields
@@ -0,0 +1,127 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"fmt"
+	"io"
+	"runtime/pprof/internal/profile"
+	"time"
+	"unsafe"
+)
+
+// A ProfileStream incrementally serializes CPU profiling samples as a
+// sequence of small pprof deltas instead of buffering an entire capture
+// in memory. Each call to Flush emits a delta profile containing only
+// the samples accumulated since the previous Flush (or since the
+// ProfileStream was created).
+//
+// The underlying profileBuilder assigns each PC and function a
+// stable ID the first time it is seen and never reuses that ID for
+// anything else, so the same frame keeps the same Location and
+// Function IDs across every delta in the stream. A delta is itself a
+// complete, independently parseable profile: it redeclares the
+// Location/Function/Mapping entries referenced by its own samples, even
+// if those entries already appeared in an earlier delta. MergeDelta
+// folds a sequence of deltas back into one cumulative profile.
+type ProfileStream struct {
+	b       *profileBuilder
+	flushed map[*profMapEntry]int64 // entry -> count already accounted for in a previous Flush
+}
+
+// NewProfileStream returns a ProfileStream ready to accept CPU profiling
+// data added via AddCPUData and to emit incremental deltas via Flush.
+func NewProfileStream() *ProfileStream {
+	return &ProfileStream{
+		b:       newProfileBuilder(io.Discard),
+		flushed: map[*profMapEntry]int64{},
+	}
+}
+
+// AddCPUData adds CPU profiling data, in the format produced by
+// runtime.CPUProfile, to the stream.
+func (s *ProfileStream) AddCPUData(data []uint64, tags []unsafe.Pointer) error {
+	return s.b.addCPUData(data, tags)
+}
+
+// Flush writes a delta profile containing every sample recorded since
+// the last Flush to w. It is safe to call Flush repeatedly over the
+// lifetime of a long-running capture; samples already written by a
+// previous Flush are not written again. If no sample was recorded since
+// the last Flush, Flush writes nothing to w.
+func (s *ProfileStream) Flush(w io.Writer) error {
+	b := s.b
+	b.pb.data = b.pb.data[:0]
+
+	round := newEmitRound()
+
+	b.pb.int64Opt(tagProfile_TimeNanos, time.Now().UnixNano())
+	b.pbValueType(tagProfile_SampleType, "samples", "count", round)
+	b.pbValueType(tagProfile_SampleType, "cpu", "nanoseconds", round)
+	b.pbValueType(tagProfile_PeriodType, "cpu", "nanoseconds", round)
+	b.pb.int64Opt(tagProfile_Period, b.period)
+
+	values := []int64{0, 0}
+	var locs []uint64
+	wroteSample := false
+
+	for e := b.m.all; e != nil; e = e.nextAll {
+		prev := s.flushed[e]
+		delta := e.count - prev
+		if delta <= 0 {
+			continue
+		}
+		s.flushed[e] = e.count
+
+		values[0] = delta
+		values[1] = delta * b.period
+
+		var labels func()
+		if e.tag != nil {
+			labels = func() {
+				for k, v := range *(*labelMap)(e.tag) {
+					b.pbLabel(tagSample_Label, k, v, 0, round)
+				}
+			}
+		}
+
+		locs = b.appendLocsForStack(locs[:0], e.stk, round)
+		b.pbSample(values, locs, labels)
+		wroteSample = true
+	}
+	if !wroteSample {
+		return nil
+	}
+
+	b.emitMappings(round)
+	// round.strings holds only the strings this round's messages
+	// actually reference, however many distinct strings (or earlier
+	// Flush calls) came before it, so this stays bounded by the size of
+	// one delta instead of growing with the life of the stream.
+	b.pb.strings(tagProfile_StringTable, round.strings)
+
+	_, err := w.Write(b.pb.data)
+	return err
+}
+
+// MergeDelta folds delta, a profile produced by a single ProfileStream.Flush
+// call, into base, the cumulative profile assembled from every earlier
+// delta in the same stream, and returns the result. Passing a nil base
+// returns delta unchanged, which starts a new cumulative profile from
+// the first delta in a stream.
+//
+// The merge matches Locations by address, mapping and Function name and
+// file rather than by ID, so samples for the same call stack in
+// successive deltas are recognized as the same stack and their values
+// are added together rather than duplicated.
+func MergeDelta(base, delta *profile.Profile) (*profile.Profile, error) {
+	if delta == nil {
+		return nil, fmt.Errorf("pprof: nil delta profile")
+	}
+	if base == nil {
+		return delta, nil
+	}
+	return profile.Merge([]*profile.Profile{base, delta})
+}
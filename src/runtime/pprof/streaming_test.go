@@ -0,0 +1,146 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof/internal/profile"
+	"testing"
+)
+
+// distinctFnSymbolizer resolves every pc to its own, never-repeated
+// Function name, so that each call references a string the stream has
+// never seen before. The name is padded to a fixed width so that its
+// encoded size doesn't vary with pc, keeping delta sizes comparable
+// across flushes.
+type distinctFnSymbolizer struct{}
+
+func (distinctFnSymbolizer) FuncForPC(pc uintptr) ([]Function, bool) {
+	return []Function{{Name: fmt.Sprintf("synthetic.fn%020d", uint64(pc)), File: "synthetic.go", Line: 1}}, true
+}
+
+func (distinctFnSymbolizer) Symbolize(p *profile.Profile) error { return nil }
+
+func TestProfileStreamFlush(t *testing.T) {
+	addr1, addr2, _, _ := testPCs(t)
+
+	s := NewProfileStream()
+	if err := s.AddCPUData([]uint64{3, 0, 1000}, nil); err != nil { // 1ms period
+		t.Fatalf("AddCPUData: %v", err)
+	}
+	if err := s.AddCPUData([]uint64{
+		5, 0, 10, uint64(addr1), uint64(addr1 + 2), // 10 samples in addr1
+	}, nil); err != nil {
+		t.Fatalf("AddCPUData: %v", err)
+	}
+
+	var buf1 bytes.Buffer
+	if err := s.Flush(&buf1); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	p1, err := profile.Parse(&buf1)
+	if err != nil {
+		t.Fatalf("profile.Parse: %v", err)
+	}
+	if len(p1.Sample) != 1 || p1.Sample[0].Value[0] != 10 {
+		t.Fatalf("first delta = %s; want a single sample with value 10", fmtJSON(p1.Sample))
+	}
+
+	// A Flush with nothing new since the last one should write nothing
+	// rather than resending the same sample.
+	var empty bytes.Buffer
+	if err := s.Flush(&empty); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if empty.Len() != 0 {
+		t.Fatalf("Flush with no new samples wrote %d bytes, want 0", empty.Len())
+	}
+
+	if err := s.AddCPUData([]uint64{
+		5, 0, 5, uint64(addr1), uint64(addr1 + 2), // 5 more samples in addr1
+		5, 0, 7, uint64(addr2), uint64(addr2 + 2), // 7 samples in addr2
+	}, nil); err != nil {
+		t.Fatalf("AddCPUData: %v", err)
+	}
+	var buf2 bytes.Buffer
+	if err := s.Flush(&buf2); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	p2, err := profile.Parse(&buf2)
+	if err != nil {
+		t.Fatalf("profile.Parse: %v", err)
+	}
+	if len(p2.Sample) != 2 {
+		t.Fatalf("second delta has %d samples, want 2", len(p2.Sample))
+	}
+
+	merged, err := MergeDelta(nil, p1)
+	if err != nil {
+		t.Fatalf("MergeDelta: %v", err)
+	}
+	merged, err = MergeDelta(merged, p2)
+	if err != nil {
+		t.Fatalf("MergeDelta: %v", err)
+	}
+
+	var total int64
+	for _, sample := range merged.Sample {
+		total += sample.Value[0]
+	}
+	if total != 22 {
+		t.Fatalf("cumulative sample count = %d, want 22", total)
+	}
+}
+
+// TestProfileStreamFlushStringTableBounded checks that a Flush delta's
+// size doesn't grow as the stream sees more and more distinct function
+// names over its lifetime. Every round re-declares the Function and
+// Location messages it uses (see emitRound), so each delta's string
+// table needs to carry the strings those messages reference -- but only
+// those, not every string ever seen in an earlier round. A stream that
+// has symbolized 50 other, unrelated PCs by now should produce the same
+// size delta for one sample as a fresh stream would.
+func TestProfileStreamFlushStringTableBounded(t *testing.T) {
+	restore := WithSymbolizer(distinctFnSymbolizer{})
+	defer restore()
+
+	s := NewProfileStream()
+	if err := s.AddCPUData([]uint64{3, 0, 1000}, nil); err != nil { // 1ms period
+		t.Fatalf("AddCPUData: %v", err)
+	}
+
+	flush := func(pc uint64) int {
+		if err := s.AddCPUData([]uint64{4, 0, 1, pc}, nil); err != nil { // 1 sample, single-frame stack
+			t.Fatalf("AddCPUData: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := s.Flush(&buf); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		return buf.Len()
+	}
+
+	early := flush(1)
+	for pc := uint64(2); pc <= 50; pc++ {
+		flush(pc)
+	}
+	late := flush(51)
+
+	if late != early {
+		t.Fatalf("delta size grew from %d to %d bytes after 50 more flushes each introducing a new function name; string table should not accumulate across flushes", early, late)
+	}
+}
+
+func TestMergeDeltaNilBase(t *testing.T) {
+	p := &profile.Profile{PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"}}
+	got, err := MergeDelta(nil, p)
+	if err != nil {
+		t.Fatalf("MergeDelta: %v", err)
+	}
+	if got != p {
+		t.Fatalf("MergeDelta(nil, p) = %v, want p itself", got)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"runtime"
+	"runtime/pprof/internal/profile"
+	"sync"
+)
+
+// Function describes one function that contains a particular program
+// counter, as reported by a Symbolizer. A single pc can resolve to more
+// than one Function when the compiler inlined the call at that pc: the
+// chain runs from the innermost inlined call out to the function that
+// physically contains the call site.
+type Function struct {
+	Name string
+	File string
+	Line int
+}
+
+// A Symbolizer resolves program counters to source-level function
+// information. Profiles built from the raw stacks the runtime delivers
+// contain only addresses; a Symbolizer is what turns those addresses
+// into the function names and file/line pairs that show up in a pprof
+// report.
+//
+// The default Symbolizer wraps runtime.CallersFrames, which only knows
+// about functions linked into the running binary. Programs that need to
+// symbolize addresses from other sources (DWARF info for a stripped
+// binary, a remote symbol server, a precomputed symbol cache, and so
+// on) can install their own Symbolizer with SetSymbolizer or
+// WithSymbolizer.
+type Symbolizer interface {
+	// FuncForPC returns the chain of Functions that pc resolves to,
+	// innermost (most deeply inlined) first and the function that
+	// physically contains the call site last, and reports whether pc
+	// could be resolved at all. A pc that was not inlined resolves to
+	// a chain of exactly one Function.
+	//
+	// pc follows the same convention as runtime.CallersFrames: for a
+	// non-leaf stack entry it is the raw return address taken from the
+	// stack, not a call instruction address backed up by the caller.
+	// Implementations built on runtime.CallersFrames need the raw
+	// address, since that function already backs up non-leaf PCs by
+	// one byte internally.
+	FuncForPC(pc uintptr) (frames []Function, ok bool)
+
+	// Symbolize fills in Line information for every Location in p
+	// whose Address this Symbolizer can resolve. Locations it cannot
+	// resolve are left untouched.
+	Symbolize(p *profile.Profile) error
+}
+
+// runtimeSymbolizer is the default Symbolizer, backed by
+// runtime.CallersFrames.
+type runtimeSymbolizer struct{}
+
+func (runtimeSymbolizer) FuncForPC(pc uintptr) ([]Function, bool) {
+	frames := runtime.CallersFrames([]uintptr{pc})
+	frame, more := frames.Next()
+	if frame.Function == "" {
+		return nil, false
+	}
+
+	fns := []Function{{Name: frame.Function, File: frame.File, Line: frame.Line}}
+	for more {
+		frame, more = frames.Next()
+		fns = append(fns, Function{Name: frame.Function, File: frame.File, Line: frame.Line})
+	}
+	return fns, true
+}
+
+func (s runtimeSymbolizer) Symbolize(p *profile.Profile) error {
+	functions := make(map[string]*profile.Function)
+	for _, fn := range p.Function {
+		functions[fn.Name] = fn
+	}
+	nextFuncID := uint64(len(p.Function))
+
+	for _, l := range p.Location {
+		if len(l.Line) > 0 {
+			continue // already symbolized
+		}
+		frames, ok := s.FuncForPC(uintptr(l.Address))
+		if !ok {
+			continue
+		}
+		lines := make([]profile.Line, len(frames))
+		for i, fn := range frames {
+			pfn, ok := functions[fn.Name]
+			if !ok {
+				nextFuncID++
+				pfn = &profile.Function{ID: nextFuncID, Name: fn.Name, SystemName: fn.Name, Filename: fn.File}
+				functions[fn.Name] = pfn
+				p.Function = append(p.Function, pfn)
+			}
+			lines[i] = profile.Line{Function: pfn, Line: int64(fn.Line)}
+		}
+		l.Line = lines
+	}
+	return nil
+}
+
+var (
+	symbolizerMu sync.Mutex
+	symbolizer   Symbolizer = runtimeSymbolizer{}
+)
+
+// SetSymbolizer installs s as the Symbolizer used by CPU profile
+// conversion for the remainder of the program. It is intended to be
+// called once, during program initialization; for scoped or
+// test-local replacement, use WithSymbolizer instead.
+func SetSymbolizer(s Symbolizer) {
+	symbolizerMu.Lock()
+	defer symbolizerMu.Unlock()
+	symbolizer = s
+}
+
+// WithSymbolizer installs s as the Symbolizer used by CPU profile
+// conversion and returns a restore function that reinstates the
+// previously installed Symbolizer. It lets tests install a fake
+// Symbolizer cleanly, without reaching into package internals:
+//
+//	restore := pprof.WithSymbolizer(fakeSymbolizer{})
+//	defer restore()
+func WithSymbolizer(s Symbolizer) (restore func()) {
+	symbolizerMu.Lock()
+	prev := symbolizer
+	symbolizer = s
+	symbolizerMu.Unlock()
+
+	return func() {
+		symbolizerMu.Lock()
+		symbolizer = prev
+		symbolizerMu.Unlock()
+	}
+}
+
+// currentSymbolizer returns the Symbolizer installed by SetSymbolizer
+// or WithSymbolizer, or the default runtime.CallersFrames-based one.
+func currentSymbolizer() Symbolizer {
+	symbolizerMu.Lock()
+	defer symbolizerMu.Unlock()
+	return symbolizer
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pprof
+
+import (
+	"runtime/pprof/internal/profile"
+	"testing"
+)
+
+// fakeSymbolizer is a Symbolizer that resolves a single known PC to a
+// fixed chain of Functions, regardless of what the runtime would say
+// about it. It lets tests exercise the builder's symbolization path
+// (including inline-frame expansion) without depending on the PCs or
+// inlining decisions of real functions in the test binary.
+type fakeSymbolizer struct {
+	pc     uintptr
+	frames []Function
+}
+
+func (s fakeSymbolizer) FuncForPC(pc uintptr) ([]Function, bool) {
+	if pc == s.pc {
+		return s.frames, true
+	}
+	return nil, false
+}
+
+func (s fakeSymbolizer) Symbolize(p *profile.Profile) error { return nil }
+
+func TestTranslateCPUProfileUsesInstalledSymbolizer(t *testing.T) {
+	addr1, _, map1, _ := testPCs(t)
+
+	restore := WithSymbolizer(fakeSymbolizer{
+		pc:     uintptr(addr1),
+		frames: []Function{{Name: "fake.Function", File: "fake.go", Line: 42}},
+	})
+	defer restore()
+
+	b := []uint64{
+		3, 0, 2000, // periodMs = 2000
+		4, 0, 10, addr1, // 10 samples in addr1, a single-frame stack
+	}
+	p, err := translateCPUProfile(b)
+	if err != nil {
+		t.Fatalf("translateCPUProfile: %v", err)
+	}
+	if len(p.Sample) != 1 {
+		t.Fatalf("len(p.Sample) = %d, want 1", len(p.Sample))
+	}
+	loc := p.Sample[0].Location[0]
+	if loc.Mapping == nil || loc.Mapping.File != map1.File {
+		t.Fatalf("loc.Mapping.File = %v\nwant = %v", fmtJSON(loc.Mapping), map1.File)
+	}
+	if len(loc.Line) != 1 || loc.Line[0].Function.Name != "fake.Function" || loc.Line[0].Line != 42 {
+		t.Fatalf("loc.Line = %v, want a single line for fake.Function:42", fmtJSON(loc.Line))
+	}
+}
+
+func TestWithSymbolizerRestoresPrevious(t *testing.T) {
+	before := currentSymbolizer()
+
+	restore := WithSymbolizer(fakeSymbolizer{})
+	if currentSymbolizer() == before {
+		t.Fatalf("WithSymbolizer did not install the replacement")
+	}
+	restore()
+
+	if currentSymbolizer() != before {
+		t.Fatalf("restore did not reinstate the previous Symbolizer")
+	}
+}